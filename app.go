@@ -10,24 +10,36 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
 )
 
 const (
-	ShutdownDelay            = 5 * time.Second
-	StatusUpdateInterval     = 3 * time.Minute
-	ShutdownPollInterval     = 10 * time.Second
-	MinUptimeBeforeShutdown  = 1 * time.Minute
-	MaxRetries                = 3
-	RetryDelay                = 5 * time.Second
+	DefaultShutdownDelay           = 5 * time.Second
+	StatusUpdateInterval           = 3 * time.Minute
+	DefaultShutdownPollInterval    = 10 * time.Second
+	DefaultMinUptimeBeforeShutdown = 1 * time.Minute
+	MaxRetries                     = 3
+	RetryDelay                     = 5 * time.Second
+)
+
+// These started life as constants but the CLI's global flags (--shutdown-delay,
+// --poll-interval, --min-uptime) need to override them at runtime, so they're
+// vars seeded with the old constant values.
+var (
+	ShutdownDelay           = DefaultShutdownDelay
+	ShutdownPollInterval    = DefaultShutdownPollInterval
+	MinUptimeBeforeShutdown = DefaultMinUptimeBeforeShutdown
 )
 
 type AuthResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	User        struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	User         struct {
 		ID string `json:"id"`
 	} `json:"user"`
 }
@@ -41,33 +53,37 @@ type Device struct {
 	LastSeen        *time.Time      `json:"last_seen"`
 	FirstOnlineAt   *time.Time      `json:"first_online_at"`
 	ShutdownRequest json.RawMessage `json:"shutdown_requested"`
+	WakeRequest     json.RawMessage `json:"wake_requested"`
 }
 
 var (
 	supabaseURL string
 	supabaseKey string
 	httpClient  = &http.Client{Timeout: 10 * time.Second}
-	authToken   string
+
+	tokenMu      sync.RWMutex
+	authToken    string
+	refreshToken string
 )
 
 func main() {
 	// Set up logging to include timestamps
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	for {
-		if err := run(); err != nil {
-			log.Printf("Application error: %v", err)
-			log.Printf("Waiting 30 seconds before retrying...")
-			time.Sleep(30 * time.Second)
-			continue
-		}
+	if err := buildCLI().Run(os.Args); err != nil {
+		log.Fatal(err)
 	}
 }
 
-func run() error {
+// loadConfigAndSignIn loads .env and the required credentials, signs in to
+// Supabase, starts the background token refresher, and returns the identity
+// every subcommand needs. It's the shared bootstrap behind run/register/
+// validate/once/status.
+func loadConfigAndSignIn() (userID, deviceName string, err error) {
 	if err := godotenv.Load(); err != nil {
-		return fmt.Errorf("error loading .env file: %v", err)
+		return "", "", fmt.Errorf("error loading .env file: %v", err)
 	}
+	loadShutdownPubKey()
 
 	supabaseURL = os.Getenv("SUPABASE_URL")
 	supabaseKey = os.Getenv("SUPABASE_KEY")
@@ -75,36 +91,60 @@ func run() error {
 	password := os.Getenv("USER_PASSWORD")
 
 	if supabaseURL == "" || supabaseKey == "" || email == "" || password == "" {
-		return fmt.Errorf("required environment variables are missing")
+		return "", "", fmt.Errorf("required environment variables are missing")
 	}
 
 	user, err := signIn(email, password)
 	if err != nil {
-		return fmt.Errorf("auth failed: %v", err)
+		return "", "", fmt.Errorf("auth failed: %v", err)
 	}
-	authToken = user.AccessToken
-	log.Printf("Authenticated as user %s", user.User.ID)
+	setTokens(user.AccessToken, user.RefreshToken)
+
+	// Keep the access token fresh for the lifetime of this process.
+	go refreshTokenLoop(user.ExpiresIn)
 
-	deviceName := getHostname()
+	return user.User.ID, getHostname(), nil
+}
+
+// run is the long-running poller: sign in, ensure a device row exists, then
+// keep status updates, shutdown polling, and (if opted in) Realtime all
+// running until one of them returns an error.
+func run() error {
+	userID, deviceName, err := loadConfigAndSignIn()
+	if err != nil {
+		return err
+	}
+	log.Printf("Authenticated as user %s", userID)
 
 	// ensure a row exists for this device
-	if err := createDevice(user.User.ID, deviceName); err != nil {
+	if err := createDevice(userID, deviceName); err != nil {
 		return fmt.Errorf("failed to create device row: %v", err)
 	}
 
 	// Create error channel for goroutines
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 3)
 
 	// Start status updater
 	go func() {
-		errChan <- updateDeviceStatus(user.User.ID, deviceName)
+		errChan <- updateDeviceStatus(userID, deviceName)
 	}()
 
 	// Start shutdown listener
 	go func() {
-		errChan <- listenForShutdownRequests(user.User.ID, deviceName)
+		errChan <- listenForShutdownRequests(userID, deviceName)
+	}()
+
+	// Start wake-on-LAN listener: watches peers' rows, not just this device's own
+	go func() {
+		errChan <- listenForWakeRequests(userID, deviceName)
 	}()
 
+	// Opt-in low-latency path: join Supabase Realtime instead of waiting on
+	// the next poll tick. The REST poller above keeps running as a fallback.
+	if os.Getenv("USE_REALTIME") == "1" {
+		go listenForShutdownRequestsRealtime(userID, deviceName)
+	}
+
 	// Wait for any error
 	return <-errChan
 }
@@ -157,36 +197,46 @@ func updateDeviceStatus(userID, name string) error {
 // listenForShutdownRequests polls for pending shutdown requests
 func listenForShutdownRequests(userID, name string) error {
 	for {
-		devices, err := fetchDevices(userID, name)
-		if err != nil {
-			log.Println("Fetch devices error:", err)
-			time.Sleep(ShutdownPollInterval)
-			continue
+		// While Realtime is connected it already drives handleShutdown for
+		// every postgres_changes event; polling REST at the same time would
+		// race it onto the same pending request. Only poll while the socket
+		// path is down (or was never enabled).
+		if !isRealtimeConnected() {
+			pollOnce(userID, name)
 		}
+		time.Sleep(ShutdownPollInterval)
+	}
+}
 
-		// if no device row yet, create it and retry
-		if len(devices) == 0 {
-			log.Printf("No row found for device %q, creating one…", name)
-			if err := createDevice(userID, name); err != nil {
-				log.Println("createDevice failed:", err)
-			} else {
-				log.Printf("Created device row for %q", name)
-			}
-			time.Sleep(ShutdownPollInterval)
-			continue
-		}
+// pollOnce runs a single fetch-devices/handle-pending-shutdown cycle. It's
+// the body of listenForShutdownRequests's loop, pulled out so the CLI's
+// `once` subcommand can run exactly one iteration for debugging.
+func pollOnce(userID, name string) {
+	devices, err := fetchDevices(userID, name)
+	if err != nil {
+		log.Println("Fetch devices error:", err)
+		return
+	}
 
-		device := devices[0]
-		if device.ShutdownRequest != nil {
-			var req map[string]interface{}
-			if err := json.Unmarshal(device.ShutdownRequest, &req); err != nil {
-				log.Println("Failed to parse shutdown request:", err)
-			} else if status, _ := req["status"].(string); status == "pending" {
-				handleShutdown(userID, name, &device, req)
-			}
+	// if no device row yet, create it and retry next cycle
+	if len(devices) == 0 {
+		log.Printf("No row found for device %q, creating one…", name)
+		if err := createDevice(userID, name); err != nil {
+			log.Println("createDevice failed:", err)
+		} else {
+			log.Printf("Created device row for %q", name)
 		}
+		return
+	}
 
-		time.Sleep(ShutdownPollInterval)
+	device := devices[0]
+	if device.ShutdownRequest != nil {
+		var req map[string]interface{}
+		if err := json.Unmarshal(device.ShutdownRequest, &req); err != nil {
+			log.Println("Failed to parse shutdown request:", err)
+		} else if status, _ := req["status"].(string); status == "pending" {
+			handleShutdown(userID, name, &device, req)
+		}
 	}
 }
 
@@ -194,11 +244,45 @@ func listenForShutdownRequests(userID, name string) error {
 func fetchDevices(userID, name string) ([]Device, error) {
 	url := supabaseURL + "/rest/v1/devices?user_id=eq." + userID +
 		"&name=eq." + name + "&select=*"
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	resp, err := httpClient.Do(req)
+	resp, err := doAuthorized(func(token string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("apikey", supabaseKey)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("fetch error %d: %s", resp.StatusCode, b)
+	}
+	var dl []Device
+	if err := json.NewDecoder(resp.Body).Decode(&dl); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// fetchAllDevices GETs every device row belonging to a user, unfiltered by
+// name. Used by the wake-on-LAN poller, which needs to see peers' rows too.
+func fetchAllDevices(userID string) ([]Device, error) {
+	url := supabaseURL + "/rest/v1/devices?user_id=eq." + userID + "&select=*"
+
+	resp, err := doAuthorized(func(token string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("apikey", supabaseKey)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -236,13 +320,17 @@ func createDevice(userID, name string) error {
 	}
 	// Send as single object, not array
 	body, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=minimal")
-
-	resp, err := httpClient.Do(req)
+	resp, err := doAuthorized(func(token string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("apikey", supabaseKey)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "return=minimal")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
@@ -260,13 +348,17 @@ func patchDevice(userID, name string, data map[string]interface{}) error {
 	url := supabaseURL + "/rest/v1/devices?user_id=eq." + userID +
 		"&name=eq." + name
 	body, _ := json.Marshal(data)
-	req, _ := http.NewRequest("PATCH", url, bytes.NewReader(body))
-	req.Header.Set("apikey", supabaseKey)
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=minimal")
-
-	resp, err := httpClient.Do(req)
+	resp, err := doAuthorized(func(token string) (*http.Request, error) {
+		req, err := http.NewRequest("PATCH", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("apikey", supabaseKey)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "return=minimal")
+		return req, nil
+	})
 	if err != nil {
 		log.Println("PATCH error:", err)
 		return err
@@ -297,6 +389,18 @@ func patchDevice(userID, name string, data map[string]interface{}) error {
 
 // handleShutdown applies logic, marks status, then shuts down
 func handleShutdown(userID, name string, dev *Device, req map[string]interface{}) {
+    // Reject unsigned/replayed/stale-future requests before acting on anything.
+    if err := verifyShutdownRequest(dev.ID, req); err != nil {
+        log.Printf("Rejecting shutdown request for %s: %v", name, err)
+        patchDevice(userID, name, map[string]interface{}{
+            "shutdown_requested": map[string]string{
+                "status": "rejected",
+                "error":  err.Error(),
+            },
+        })
+        return
+    }
+
     // Parse expires_at from ISO string instead of float64
     if expiresStr, ok := req["expires_at"].(string); ok {
         expiresAt, err := time.Parse(time.RFC3339, expiresStr)
@@ -324,6 +428,24 @@ func handleShutdown(userID, name string, dev *Device, req map[string]interface{}
         "status":            "off",
         "last_seen":        time.Now().UTC().Format(time.RFC3339),
     })
+
+    // Run operator-configured drain hooks (stop containers, flush caches, …)
+    // before touching the OS. A failing/over-budget hook aborts the shutdown.
+    hookLog, failedHook, hookErr := runPreShutdownHooks()
+    if len(hookLog) > 0 {
+        patchDevice(userID, name, map[string]interface{}{"shutdown_log": hookLog})
+    }
+    if hookErr != nil {
+        log.Printf("pre-shutdown hook %q failed: %v", failedHook, hookErr)
+        patchDevice(userID, name, map[string]interface{}{
+            "shutdown_requested": map[string]string{
+                "status": "hook_timeout",
+                "error":  fmt.Sprintf("%s: %v", failedHook, hookErr),
+            },
+        })
+        return
+    }
+
     time.Sleep(ShutdownDelay)
 
     // Execute shutdown command based on the OS
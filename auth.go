@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RefreshSafetyMargin is how long before the access token's actual expiry we
+// proactively refresh it, so a slow request never races an expiring token.
+const RefreshSafetyMargin = 1 * time.Minute
+
+// getAuthToken returns the current access token for use in an Authorization header.
+func getAuthToken() string {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return authToken
+}
+
+// setTokens atomically swaps in a new access/refresh token pair.
+func setTokens(access, refresh string) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	authToken = access
+	refreshToken = refresh
+}
+
+// refreshTokenLoop re-authenticates a minute before the access token expires,
+// and keeps doing so for as long as the process runs. expiresIn is the
+// expires_in (seconds) Supabase returned with the current token.
+func refreshTokenLoop(expiresIn int) {
+	if expiresIn <= 0 {
+		expiresIn = 3600 // Supabase's default access token lifetime
+	}
+	for {
+		wait := time.Duration(expiresIn)*time.Second - RefreshSafetyMargin
+		if wait < 0 {
+			wait = 0
+		}
+		time.Sleep(wait)
+
+		if err := doRefreshToken(); err != nil {
+			log.Printf("token refresh failed, will retry sooner: %v", err)
+			expiresIn = int(RefreshSafetyMargin.Seconds())
+			continue
+		}
+		expiresIn = 3600
+	}
+}
+
+// doRefreshToken exchanges the stored refresh token for a new access token
+// and atomically swaps it in.
+func doRefreshToken() error {
+	tokenMu.RLock()
+	rt := refreshToken
+	tokenMu.RUnlock()
+	if rt == "" {
+		return fmt.Errorf("no refresh token available")
+	}
+
+	url := supabaseURL + "/auth/v1/token?grant_type=refresh_token"
+	body, _ := json.Marshal(map[string]string{"refresh_token": rt})
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", supabaseKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("refresh error %d: %s", resp.StatusCode, b)
+	}
+
+	var ar AuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return err
+	}
+	setTokens(ar.AccessToken, ar.RefreshToken)
+	log.Println("access token refreshed")
+	return nil
+}
+
+// doAuthorized runs an HTTP request built by newReq with the current access
+// token. If Supabase responds 401, it refreshes the token once and retries
+// the request with the new one before giving up.
+func doAuthorized(newReq func(token string) (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq(getAuthToken())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	log.Println("request unauthorized, refreshing access token and retrying once")
+	if err := doRefreshToken(); err != nil {
+		return nil, fmt.Errorf("token refresh after 401 failed: %v", err)
+	}
+
+	req, err = newReq(getAuthToken())
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
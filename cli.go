@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// buildCLI wires up the agent's subcommands. Global flags override the env
+// vars the constants used to be baked from, so timing can be tuned per
+// invocation instead of only at compile time.
+func buildCLI() *cli.App {
+	return &cli.App{
+		Name:  "shutdown-agent",
+		Usage: "remote shutdown agent backed by Supabase",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "supabase-url", EnvVars: []string{"SUPABASE_URL"}, Usage: "Supabase project URL"},
+			&cli.DurationFlag{Name: "poll-interval", Value: DefaultShutdownPollInterval, Usage: "how often to poll for shutdown requests"},
+			&cli.DurationFlag{Name: "min-uptime", Value: DefaultMinUptimeBeforeShutdown, Usage: "minimum uptime before a shutdown request is honored"},
+			&cli.DurationFlag{Name: "shutdown-delay", Value: DefaultShutdownDelay, Usage: "delay between marking shutting_down and issuing the OS shutdown"},
+		},
+		Before: applyGlobalFlags,
+		Commands: []*cli.Command{
+			runCommand,
+			registerCommand,
+			validateCommand,
+			onceCommand,
+			statusCommand,
+			controllerCommand,
+			wakeCommand,
+		},
+	}
+}
+
+func applyGlobalFlags(c *cli.Context) error {
+	if v := c.String("supabase-url"); v != "" {
+		os.Setenv("SUPABASE_URL", v)
+	}
+	ShutdownPollInterval = c.Duration("poll-interval")
+	MinUptimeBeforeShutdown = c.Duration("min-uptime")
+	ShutdownDelay = c.Duration("shutdown-delay")
+	return nil
+}
+
+var runCommand = &cli.Command{
+	Name:  "run",
+	Usage: "run the agent continuously, retrying on error (the original default behavior)",
+	Action: func(c *cli.Context) error {
+		for {
+			if err := run(); err != nil {
+				log.Printf("Application error: %v", err)
+				log.Printf("Waiting 30 seconds before retrying...")
+				time.Sleep(30 * time.Second)
+				continue
+			}
+		}
+	},
+}
+
+var registerCommand = &cli.Command{
+	Name:  "register",
+	Usage: "sign in, create this device's row in Supabase if missing, and exit",
+	Action: func(c *cli.Context) error {
+		userID, deviceName, err := loadConfigAndSignIn()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		if err := createDevice(userID, deviceName); err != nil {
+			return cli.Exit(fmt.Errorf("failed to create device row: %v", err), 1)
+		}
+		log.Printf("Registered device %q for user %s", deviceName, userID)
+		return nil
+	},
+}
+
+var validateCommand = &cli.Command{
+	Name:  "validate",
+	Usage: "check required env vars, sign in, and fetch this device's row; exits non-zero on any failure",
+	Action: func(c *cli.Context) error {
+		userID, deviceName, err := loadConfigAndSignIn()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		devices, err := fetchDevices(userID, deviceName)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("failed to fetch device row: %v", err), 1)
+		}
+		if len(devices) == 0 {
+			return cli.Exit(fmt.Errorf("no device row found for %q; run 'register' first", deviceName), 1)
+		}
+
+		fmt.Printf("OK: authenticated as %s, device %q status=%q\n", userID, deviceName, devices[0].Status)
+		return nil
+	},
+}
+
+var onceCommand = &cli.Command{
+	Name:  "once",
+	Usage: "sign in, run a single poll iteration, and handle any pending shutdown request",
+	Action: func(c *cli.Context) error {
+		userID, deviceName, err := loadConfigAndSignIn()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		pollOnce(userID, deviceName)
+		return nil
+	},
+}
+
+var statusCommand = &cli.Command{
+	Name:  "status",
+	Usage: "print this device's row as JSON",
+	Action: func(c *cli.Context) error {
+		userID, deviceName, err := loadConfigAndSignIn()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		devices, err := fetchDevices(userID, deviceName)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("failed to fetch device row: %v", err), 1)
+		}
+		if len(devices) == 0 {
+			return cli.Exit(fmt.Errorf("no device row found for %q", deviceName), 1)
+		}
+
+		out, err := json.MarshalIndent(devices[0], "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	},
+}
+
+var controllerCommand = &cli.Command{
+	Name:  "controller",
+	Usage: "shut down a fleet of targets over SSH instead of running the agent on each one",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Required: true, Usage: "path to a JSON file listing SSH targets"},
+	},
+	Action: func(c *cli.Context) error {
+		if err := runController(c.String("config")); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	},
+}
+
+var wakeCommand = &cli.Command{
+	Name:  "wake",
+	Usage: "send a Wake-on-LAN magic packet directly, without touching Supabase",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "mac", Required: true, Usage: "target MAC address, e.g. aa:bb:cc:dd:ee:ff"},
+		&cli.StringFlag{Name: "broadcast", Value: "255.255.255.255", Usage: "broadcast address to send the magic packet to"},
+	},
+	Action: func(c *cli.Context) error {
+		if err := sendMagicPacket(c.String("mac"), c.String("broadcast")); err != nil {
+			return cli.Exit(err, 1)
+		}
+		fmt.Printf("sent magic packet to %s via %s\n", c.String("mac"), c.String("broadcast"))
+		return nil
+	},
+}
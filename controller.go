@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// ControllerWorkerPoolSize bounds how many targets are shut down at once.
+	ControllerWorkerPoolSize = 8
+	ControllerDialTimeout    = 10 * time.Second
+)
+
+// controllerTarget is one remote machine listed in the controller's config
+// file: its Supabase identity (for status reporting) plus how to SSH in.
+type controllerTarget struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	Host   string `json:"host"` // host or host:port; defaults to port 22
+	User   string `json:"user"`
+	OS     string `json:"os"` // linux, darwin, windows; defaults to linux
+}
+
+// runController loads the targets config and shuts each target down over
+// SSH, concurrently and bounded by ControllerWorkerPoolSize. It writes the
+// same shutdown_requested status transitions (shutting_down -> done/failed)
+// the local agent writes, just driven from a single coordinator instead of
+// by the target itself — for diskless/headless machines that can't run the
+// agent locally.
+func runController(configPath string) error {
+	// Sign in as the coordinator so patchDevice can report status for
+	// whichever targets' rows this account has write access to.
+	if _, _, err := loadConfigAndSignIn(); err != nil {
+		return err
+	}
+
+	targets, err := loadControllerTargets(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load controller config: %v", err)
+	}
+
+	signer, err := loadSSHSigner()
+	if err != nil {
+		return fmt.Errorf("failed to load SSH key: %v", err)
+	}
+
+	hostKeyCallback, err := loadHostKeyCallback()
+	if err != nil {
+		return fmt.Errorf("failed to load known_hosts: %v", err)
+	}
+
+	sem := make(chan struct{}, ControllerWorkerPoolSize)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		t := t
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			shutdownTarget(t, signer, hostKeyCallback)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// shutdownTarget verifies a target is up long enough to honor a shutdown,
+// then shuts it down over SSH, reporting each transition back to Supabase.
+func shutdownTarget(t controllerTarget, signer ssh.Signer, hostKeyCallback ssh.HostKeyCallback) {
+	patchDevice(t.UserID, t.Name, map[string]interface{}{
+		"shutdown_requested": map[string]string{"status": "shutting_down"},
+	})
+
+	client, err := dialSSH(t, signer, hostKeyCallback)
+	if err != nil {
+		log.Printf("controller: %s: ssh dial failed: %v", t.Name, err)
+		reportControllerFailure(t, err)
+		return
+	}
+	defer client.Close()
+
+	uptimeOK, err := checkMinUptime(client)
+	if err != nil {
+		log.Printf("controller: %s: uptime check failed: %v", t.Name, err)
+		reportControllerFailure(t, err)
+		return
+	}
+	if !uptimeOK {
+		log.Printf("controller: %s: too recently booted, skipping shutdown", t.Name)
+		patchDevice(t.UserID, t.Name, map[string]interface{}{
+			"shutdown_requested": map[string]string{"status": "skipped_min_uptime"},
+		})
+		return
+	}
+
+	if err := runRemoteShutdownCommand(client, t.OS); err != nil {
+		log.Printf("controller: %s: shutdown command failed: %v", t.Name, err)
+		reportControllerFailure(t, err)
+		return
+	}
+
+	patchDevice(t.UserID, t.Name, map[string]interface{}{
+		"shutdown_requested": map[string]string{"status": "done"},
+		"status":             "off",
+	})
+	log.Printf("controller: %s: shutdown command executed successfully", t.Name)
+}
+
+func reportControllerFailure(t controllerTarget, err error) {
+	patchDevice(t.UserID, t.Name, map[string]interface{}{
+		"shutdown_requested": map[string]string{"status": "failed", "error": err.Error()},
+	})
+}
+
+// dialSSH connects to a target with key-based auth only.
+func dialSSH(t controllerTarget, signer ssh.Signer, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	cfg := &ssh.ClientConfig{
+		User:            t.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         ControllerDialTimeout,
+	}
+	host := t.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return ssh.Dial("tcp", host, cfg)
+}
+
+// loadHostKeyCallback verifies targets against KNOWN_HOSTS_PATH, or
+// ~/.ssh/known_hosts if unset, so a MITM'd SSH session can't be used to issue
+// a privileged shutdown command: an unrecognized or mismatched host key fails
+// the dial instead of being silently accepted.
+func loadHostKeyCallback() (ssh.HostKeyCallback, error) {
+	path := os.Getenv("KNOWN_HOSTS_PATH")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(path)
+}
+
+// checkMinUptime mirrors MinUptimeBeforeShutdown, but reads the target's own
+// uptime over the SSH session instead of a locally-tracked first_online_at.
+func checkMinUptime(client *ssh.Client) (bool, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	out, err := session.Output("cat /proc/uptime")
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return false, fmt.Errorf("unexpected uptime output: %q", out)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return false, err
+	}
+	uptime := time.Duration(seconds * float64(time.Second))
+	return uptime >= MinUptimeBeforeShutdown, nil
+}
+
+// runRemoteShutdownCommand picks the OS-appropriate shutdown command, same
+// choices as handleShutdown's local switch, and runs it over the session.
+func runRemoteShutdownCommand(client *ssh.Client, targetOS string) error {
+	if targetOS == "" {
+		targetOS = "linux"
+	}
+
+	var cmd string
+	switch targetOS {
+	case "windows":
+		cmd = "shutdown /s /t 0"
+	case "darwin":
+		cmd = `osascript -e 'tell application "System Events" to shut down'`
+	case "linux":
+		cmd = "systemctl poweroff"
+	default:
+		return fmt.Errorf("unsupported OS: %s", targetOS)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+	session.Stdout = &out
+	session.Stderr = &out
+	if err := session.Run(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, out.String())
+	}
+	return nil
+}
+
+// loadControllerTargets reads a JSON array of controllerTarget from path.
+func loadControllerTargets(path string) ([]controllerTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []controllerTarget
+	if err := json.NewDecoder(f).Decode(&targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// loadSSHSigner loads a private key from SSH_KEY_PATH, or the first of
+// ~/.ssh/id_ed25519 / ~/.ssh/id_rsa that exists.
+func loadSSHSigner() (ssh.Signer, error) {
+	path := os.Getenv("SSH_KEY_PATH")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range []string{"id_ed25519", "id_rsa"} {
+			candidate := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no SSH key found; set SSH_KEY_PATH or place one at ~/.ssh/id_ed25519 or ~/.ssh/id_rsa")
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(key)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// HookTimeout bounds how long any single pre-shutdown hook may run.
+	HookTimeout = 30 * time.Second
+	// HookBudget bounds the total wall-clock time spent draining before a
+	// shutdown gives up on running any remaining hooks.
+	HookBudget = 2 * time.Minute
+)
+
+// preShutdownHook is one drain step, either an executable from HOOKS_DIR or
+// an entry from the PRE_SHUTDOWN_HOOKS JSON array. useShell is set for the
+// latter, since those entries may carry arguments ("docker compose down")
+// and need a shell to split and exec them.
+type preShutdownHook struct {
+	name     string
+	cmd      string
+	useShell bool
+}
+
+// hookResult is one hook's outcome, shaped for the shutdown_log JSONB column.
+type hookResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// runPreShutdownHooks runs the configured drain hooks in lexical/declared
+// order, tracking elapsed time against HookBudget the way a retry-timeout
+// loop tracks attempts against a deadline: before starting the next hook, if
+// elapsed-so-far plus that hook's own HookTimeout would blow the budget, the
+// remaining hooks are skipped and the shutdown aborts. It returns the per-hook
+// log (for shutdown_log) and, if something went wrong, the offending hook's
+// name and error.
+func runPreShutdownHooks() (entries []hookResult, failedHook string, failErr error) {
+	hooks := loadPreShutdownHooks()
+
+	var elapsed time.Duration
+	for _, h := range hooks {
+		if elapsed+HookTimeout > HookBudget {
+			return entries, h.name, fmt.Errorf("running %q would exceed hook budget of %s", h.name, HookBudget)
+		}
+
+		start := time.Now()
+		out, err := runHook(h)
+		d := time.Since(start)
+		elapsed += d
+
+		res := hookResult{Name: h.name, Output: out, Duration: d.String()}
+		if err != nil {
+			res.Status = "failed"
+			res.Error = err.Error()
+			entries = append(entries, res)
+			return entries, h.name, err
+		}
+
+		res.Status = "ok"
+		entries = append(entries, res)
+	}
+	return entries, "", nil
+}
+
+// runHook executes a single hook, killing it after HookTimeout.
+func runHook(h preShutdownHook) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if h.useShell {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.cmd)
+	} else {
+		cmd = exec.CommandContext(ctx, h.cmd)
+	}
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return buf.String(), fmt.Errorf("hook timed out after %s", HookTimeout)
+	}
+	return buf.String(), err
+}
+
+// loadPreShutdownHooks reads hooks from HOOKS_DIR (one per executable file,
+// lexical order) or, failing that, from a PRE_SHUTDOWN_HOOKS JSON array of
+// command strings. No configuration means no hooks, and shutdown proceeds
+// exactly as before this feature existed.
+func loadPreShutdownHooks() []preShutdownHook {
+	if dir := os.Getenv("HOOKS_DIR"); dir != "" {
+		hooks, err := loadHooksFromDir(dir)
+		if err != nil {
+			log.Printf("HOOKS_DIR %q: %v", dir, err)
+			return nil
+		}
+		return hooks
+	}
+	if raw := os.Getenv("PRE_SHUTDOWN_HOOKS"); raw != "" {
+		var cmds []string
+		if err := json.Unmarshal([]byte(raw), &cmds); err != nil {
+			log.Printf("PRE_SHUTDOWN_HOOKS is not a JSON array of strings: %v", err)
+			return nil
+		}
+		hooks := make([]preShutdownHook, 0, len(cmds))
+		for _, c := range cmds {
+			hooks = append(hooks, preShutdownHook{name: c, cmd: c, useShell: true})
+		}
+		return hooks
+	}
+	return nil
+}
+
+func loadHooksFromDir(dir string) ([]preShutdownHook, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.Mode()&0111 == 0 {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	hooks := make([]preShutdownHook, 0, len(names))
+	for _, n := range names {
+		hooks = append(hooks, preShutdownHook{name: n, cmd: filepath.Join(dir, n)})
+	}
+	return hooks, nil
+}
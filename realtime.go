@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	RealtimeHeartbeatInterval = 30 * time.Second
+	RealtimeMaxBackoff        = 2 * time.Minute
+	// RealtimeJoinTimeout bounds how long we wait for the phx_reply that
+	// confirms (or rejects) the channel join before giving up on it.
+	RealtimeJoinTimeout = 10 * time.Second
+	realtimeJoinRef     = "1"
+)
+
+// realtimeConnected tracks whether the Realtime socket is currently joined,
+// so listenForShutdownRequests can skip polling REST while the socket is up
+// and only drive handleShutdown from REST when the socket path is down.
+var realtimeConnected int32
+
+func isRealtimeConnected() bool {
+	return atomic.LoadInt32(&realtimeConnected) == 1
+}
+
+// realtimePhxMessage mirrors the Phoenix channel envelope Supabase Realtime speaks
+// over the websocket: every inbound/outbound frame is one of these.
+type realtimePhxMessage struct {
+	Topic   string          `json:"topic"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	Ref     string          `json:"ref"`
+}
+
+// listenForShutdownRequestsRealtime joins the Supabase Realtime channel for this
+// device and dispatches incoming postgres_changes events into handleShutdown.
+// It reconnects with exponential backoff on any socket/auth failure; the REST
+// poller in listenForShutdownRequests keeps running alongside it as a fallback
+// whenever the socket is down.
+func listenForShutdownRequestsRealtime(userID, name string) {
+	backoff := time.Second
+	for {
+		connectedAt := time.Now()
+		err := runRealtimeSession(userID, name)
+		log.Printf("realtime: session ended: %v (retrying in %s)", err, backoff)
+		if time.Since(connectedAt) > RealtimeHeartbeatInterval {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < RealtimeMaxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// runRealtimeSession opens one websocket connection, joins the devices channel
+// filtered to this host, and blocks reading frames until the connection drops.
+func runRealtimeSession(userID, name string) error {
+	u := realtimeURL()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		return fmt.Errorf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	topic := fmt.Sprintf("realtime:public:devices:user_id=eq.%s", userID)
+	payload, _ := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{
+			"postgres_changes": []map[string]interface{}{
+				{
+					"event":  "UPDATE",
+					"schema": "public",
+					"table":  "devices",
+					"filter": "name=eq." + name,
+				},
+			},
+		},
+	})
+	join := realtimePhxMessage{Topic: topic, Event: "phx_join", Payload: payload, Ref: realtimeJoinRef}
+	if err := conn.WriteJSON(join); err != nil {
+		return fmt.Errorf("join: %v", err)
+	}
+
+	// Don't trust the join until Phoenix actually acks it: a bad topic/filter,
+	// or RLS rejecting the anon-keyed socket (which never carries the bearer
+	// token REST calls use), sends phx_reply with status "error" while the
+	// socket and heartbeats keep working fine. Treating that as "connected"
+	// would permanently starve the REST fallback of any shutdown requests.
+	if err := awaitJoinReply(conn, userID, name); err != nil {
+		return fmt.Errorf("join not confirmed: %v", err)
+	}
+
+	atomic.StoreInt32(&realtimeConnected, 1)
+	defer atomic.StoreInt32(&realtimeConnected, 0)
+
+	heartbeatErr := make(chan error, 1)
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	go func() {
+		ticker := time.NewTicker(RealtimeHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				hb := realtimePhxMessage{Topic: "phoenix", Event: "phx_heartbeat", Payload: json.RawMessage("{}"), Ref: "hb"}
+				if err := conn.WriteJSON(hb); err != nil {
+					heartbeatErr <- fmt.Errorf("heartbeat: %v", err)
+					return
+				}
+			case <-stopHeartbeat:
+				return
+			}
+		}
+	}()
+
+	log.Printf("realtime: connected and joined %q", topic)
+	for {
+		var msg realtimePhxMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			select {
+			case herr := <-heartbeatErr:
+				return herr
+			default:
+				return fmt.Errorf("read: %v", err)
+			}
+		}
+		handleRealtimeMessage(userID, name, msg)
+	}
+}
+
+// awaitJoinReply blocks until the phx_reply for our join ref arrives and
+// confirms the channel was actually joined. Any other frame that shows up
+// first (e.g. an UPDATE racing the ack) is dispatched normally while we keep
+// waiting. Returns an error on timeout, socket error, or a non-"ok" reply.
+func awaitJoinReply(conn *websocket.Conn, userID, name string) error {
+	conn.SetReadDeadline(time.Now().Add(RealtimeJoinTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		var msg realtimePhxMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("waiting for phx_reply: %v", err)
+		}
+		if msg.Event != "phx_reply" || msg.Ref != realtimeJoinRef {
+			handleRealtimeMessage(userID, name, msg)
+			continue
+		}
+
+		var reply struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(msg.Payload, &reply); err != nil {
+			return fmt.Errorf("parsing phx_reply: %v", err)
+		}
+		if reply.Status != "ok" {
+			return fmt.Errorf("channel join rejected: %s", msg.Payload)
+		}
+		return nil
+	}
+}
+
+// handleRealtimeMessage unwraps a postgres_changes frame and, if it carries a
+// pending shutdown request for this device, runs it through handleShutdown.
+func handleRealtimeMessage(userID, name string, msg realtimePhxMessage) {
+	if msg.Event != "postgres_changes" {
+		return
+	}
+
+	var change struct {
+		Data struct {
+			Record Device `json:"record"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Payload, &change); err != nil {
+		log.Println("realtime: failed to parse postgres_changes payload:", err)
+		return
+	}
+
+	dev := change.Data.Record
+	if dev.ShutdownRequest == nil {
+		return
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(dev.ShutdownRequest, &req); err != nil {
+		log.Println("realtime: failed to parse shutdown request:", err)
+		return
+	}
+	if status, _ := req["status"].(string); status == "pending" {
+		handleShutdown(userID, name, &dev, req)
+	}
+}
+
+// realtimeURL builds the wss:// Realtime endpoint from the configured Supabase
+// project URL, e.g. https://xyz.supabase.co -> wss://xyz.supabase.co/realtime/v1/websocket.
+func realtimeURL() string {
+	host := strings.TrimPrefix(strings.TrimPrefix(supabaseURL, "https://"), "http://")
+	u := url.URL{Scheme: "wss", Host: host, Path: "/realtime/v1/websocket"}
+	q := u.Query()
+	q.Set("apikey", supabaseKey)
+	q.Set("vsn", "1.0.0")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
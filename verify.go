@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// MaxRequestAge caps how far in the future a shutdown request's
+	// expires_at may be, so a signed request can't be hoarded and replayed
+	// much later than when it was issued.
+	MaxRequestAge = 24 * time.Hour
+
+	nonceBucket = "used_nonces"
+)
+
+var shutdownPubKey ed25519.PublicKey
+
+var (
+	nonceDB     *bbolt.DB
+	nonceDBOnce sync.Once
+	nonceDBErr  error
+)
+
+// loadShutdownPubKey reads the Ed25519 verification key from SHUTDOWN_PUBKEY
+// (base64-encoded, raw 32 bytes) at startup. If it's unset, shutdown requests
+// are accepted unverified, same as before this feature existed — operators
+// opt into verification by setting the key.
+func loadShutdownPubKey() {
+	raw := os.Getenv("SHUTDOWN_PUBKEY")
+	if raw == "" {
+		log.Println("SHUTDOWN_PUBKEY not set; shutdown requests will not be signature-verified")
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		log.Fatalf("invalid SHUTDOWN_PUBKEY: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		log.Fatalf("SHUTDOWN_PUBKEY must decode to %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	shutdownPubKey = ed25519.PublicKey(key)
+}
+
+// verifyShutdownRequest checks a shutdown_requested payload's signature,
+// freshness, and nonce before handleShutdown is allowed to act on it. sig
+// covers "device_id|expires_at|nonce". Returns nil if verification is not
+// configured (no SHUTDOWN_PUBKEY).
+func verifyShutdownRequest(deviceID string, req map[string]interface{}) error {
+	if len(shutdownPubKey) == 0 {
+		return nil
+	}
+
+	expiresStr, _ := req["expires_at"].(string)
+	nonce, _ := req["nonce"].(string)
+	sigB64, _ := req["sig"].(string)
+	if expiresStr == "" || nonce == "" || sigB64 == "" {
+		return fmt.Errorf("request is missing expires_at/nonce/sig")
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, expiresStr)
+	if err != nil {
+		return fmt.Errorf("invalid expires_at: %v", err)
+	}
+	if time.Until(expiresAt) > MaxRequestAge {
+		return fmt.Errorf("expires_at is more than %s in the future", MaxRequestAge)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return fmt.Errorf("invalid sig encoding: %v", err)
+	}
+
+	msg := []byte(deviceID + "|" + expiresStr + "|" + nonce)
+	if !ed25519.Verify(shutdownPubKey, msg, sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	if err := checkAndMarkNonce(nonce); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getNonceDB lazily opens the on-disk nonce store, so a replayed request
+// still gets caught after the agent restarts or the machine reboots.
+func getNonceDB() (*bbolt.DB, error) {
+	nonceDBOnce.Do(func() {
+		path := os.Getenv("NONCE_DB_PATH")
+		if path == "" {
+			path = "shutdown-agent-nonces.db"
+		}
+		db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			nonceDBErr = err
+			return
+		}
+		err = db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(nonceBucket))
+			return err
+		})
+		if err != nil {
+			db.Close()
+			nonceDBErr = err
+			return
+		}
+		nonceDB = db
+	})
+	return nonceDB, nonceDBErr
+}
+
+// checkAndMarkNonce atomically checks whether nonce has been seen before and,
+// if not, records it as used — all within a single bbolt write transaction,
+// so two goroutines verifying the same signed request concurrently can't both
+// pass the check before either one's put lands.
+func checkAndMarkNonce(nonce string) error {
+	db, err := getNonceDB()
+	if err != nil {
+		return fmt.Errorf("nonce store error: %v", err)
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(nonceBucket))
+		if b.Get([]byte(nonce)) != nil {
+			return fmt.Errorf("nonce %q was already used (replay)", nonce)
+		}
+		return b.Put([]byte(nonce), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetNonceStore points the nonce store at a fresh temp file and clears the
+// sync.Once so getNonceDB() reopens it, isolating each test.
+func resetNonceStore(t *testing.T) {
+	t.Helper()
+	t.Setenv("NONCE_DB_PATH", filepath.Join(t.TempDir(), "nonces.db"))
+	nonceDBOnce = sync.Once{}
+	nonceDB = nil
+	nonceDBErr = nil
+	t.Cleanup(func() {
+		if nonceDB != nil {
+			nonceDB.Close()
+		}
+		nonceDBOnce = sync.Once{}
+		nonceDB = nil
+		nonceDBErr = nil
+	})
+}
+
+func sign(priv ed25519.PrivateKey, deviceID, expiresAt, nonce string) string {
+	msg := []byte(deviceID + "|" + expiresAt + "|" + nonce)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, msg))
+}
+
+func TestVerifyShutdownRequest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdownPubKey = pub
+	t.Cleanup(func() { shutdownPubKey = nil })
+
+	const deviceID = "device-1"
+	validExpiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	t.Run("valid signature accepted", func(t *testing.T) {
+		resetNonceStore(t)
+		nonce := "nonce-ok"
+		req := map[string]interface{}{
+			"expires_at": validExpiresAt,
+			"nonce":      nonce,
+			"sig":        sign(priv, deviceID, validExpiresAt, nonce),
+		}
+		if err := verifyShutdownRequest(deviceID, req); err != nil {
+			t.Fatalf("expected valid request to be accepted, got: %v", err)
+		}
+	})
+
+	t.Run("bad signature rejected", func(t *testing.T) {
+		resetNonceStore(t)
+		nonce := "nonce-bad-sig"
+		req := map[string]interface{}{
+			"expires_at": validExpiresAt,
+			"nonce":      nonce,
+			"sig":        base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize)),
+		}
+		if err := verifyShutdownRequest(deviceID, req); err == nil {
+			t.Fatal("expected request with an invalid signature to be rejected")
+		}
+	})
+
+	t.Run("replayed nonce rejected", func(t *testing.T) {
+		resetNonceStore(t)
+		nonce := "nonce-replay"
+		req := map[string]interface{}{
+			"expires_at": validExpiresAt,
+			"nonce":      nonce,
+			"sig":        sign(priv, deviceID, validExpiresAt, nonce),
+		}
+		if err := verifyShutdownRequest(deviceID, req); err != nil {
+			t.Fatalf("first use of the nonce should be accepted, got: %v", err)
+		}
+		if err := verifyShutdownRequest(deviceID, req); err == nil {
+			t.Fatal("expected a replayed nonce to be rejected")
+		}
+	})
+
+	t.Run("far future expires_at rejected", func(t *testing.T) {
+		resetNonceStore(t)
+		nonce := "nonce-far-future"
+		farExpiresAt := time.Now().Add(2 * MaxRequestAge).UTC().Format(time.RFC3339)
+		req := map[string]interface{}{
+			"expires_at": farExpiresAt,
+			"nonce":      nonce,
+			"sig":        sign(priv, deviceID, farExpiresAt, nonce),
+		}
+		if err := verifyShutdownRequest(deviceID, req); err == nil {
+			t.Fatal("expected an expires_at far in the future to be rejected")
+		}
+	})
+
+	t.Run("verification skipped when no pubkey configured", func(t *testing.T) {
+		resetNonceStore(t)
+		shutdownPubKey = nil
+		defer func() { shutdownPubKey = pub }()
+
+		req := map[string]interface{}{}
+		if err := verifyShutdownRequest(deviceID, req); err != nil {
+			t.Fatalf("expected nil pubkey to skip verification, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// WakeTimeout bounds how long the electing peer waits for a woken target to
+// report itself back online before giving up.
+const WakeTimeout = 3 * time.Minute
+
+// listenForWakeRequests polls every device row for this user — not just this
+// host's own row — looking for a pending wake_requested entry. If this host
+// is the elected peer for that request (lowest device ID among the user's
+// currently-online devices), it sends the WoL packet and watches for the
+// target to come back online.
+func listenForWakeRequests(userID, name string) error {
+	for {
+		devices, err := fetchAllDevices(userID)
+		if err != nil {
+			log.Println("wol: fetch devices error:", err)
+			time.Sleep(ShutdownPollInterval)
+			continue
+		}
+
+		for _, dev := range devices {
+			if dev.Name == name || dev.WakeRequest == nil {
+				continue
+			}
+			var wr map[string]interface{}
+			if err := json.Unmarshal(dev.WakeRequest, &wr); err != nil {
+				log.Println("wol: failed to parse wake_requested:", err)
+				continue
+			}
+			if status, _ := wr["status"].(string); status != "pending" {
+				continue
+			}
+			if !isElectedWaker(devices, name) {
+				continue
+			}
+			handleWakeRequest(userID, dev, wr)
+		}
+
+		time.Sleep(ShutdownPollInterval)
+	}
+}
+
+// isElectedWaker reports whether this host is the lowest-ID online device
+// for the user, i.e. the one responsible for sending the magic packet.
+func isElectedWaker(devices []Device, name string) bool {
+	var ownID, lowestID string
+	for _, d := range devices {
+		if d.Status != "on" {
+			continue
+		}
+		if d.Name == name {
+			ownID = d.ID
+		}
+		if lowestID == "" || d.ID < lowestID {
+			lowestID = d.ID
+		}
+	}
+	return ownID != "" && ownID == lowestID
+}
+
+// handleWakeRequest sends the magic packet for one pending wake_requested row
+// and reports the outcome back to Supabase.
+func handleWakeRequest(userID string, target Device, wr map[string]interface{}) {
+	mac, _ := wr["mac"].(string)
+	broadcast, _ := wr["broadcast"].(string)
+	if mac == "" || broadcast == "" {
+		log.Printf("wol: wake request for %q missing mac/broadcast", target.Name)
+		return
+	}
+
+	log.Printf("wol: sending magic packet to %s (%s) via %s", target.Name, mac, broadcast)
+	if err := sendMagicPacket(mac, broadcast); err != nil {
+		log.Printf("wol: failed to send magic packet to %s: %v", target.Name, err)
+		patchDevice(userID, target.Name, map[string]interface{}{
+			"wake_requested": map[string]string{"status": "failed", "error": err.Error()},
+		})
+		return
+	}
+
+	online, latest := waitForDeviceOnline(userID, target.Name, WakeTimeout)
+	if online {
+		log.Printf("wol: %s is back online", target.Name)
+		patchDevice(userID, target.Name, map[string]interface{}{
+			"wake_requested": map[string]string{"status": "done"},
+		})
+		return
+	}
+
+	log.Printf("wol: timed out waiting for %s to come online", target.Name)
+	patchDevice(userID, target.Name, map[string]interface{}{
+		"wake_requested": map[string]string{
+			"status":    "failed",
+			"last_seen": lastSeenString(latest),
+		},
+	})
+}
+
+// waitForDeviceOnline polls a single device's row until its status flips to
+// "on" or timeout elapses. It returns the freshest Device row it observed
+// (even on timeout) so callers don't have to fall back to a pre-wake
+// snapshot that may be stale by up to timeout.
+func waitForDeviceOnline(userID, name string, timeout time.Duration) (bool, Device) {
+	var latest Device
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		devices, err := fetchDevices(userID, name)
+		if err == nil && len(devices) > 0 {
+			latest = devices[0]
+			if latest.Status == "on" {
+				return true, latest
+			}
+		}
+		time.Sleep(ShutdownPollInterval)
+	}
+	return false, latest
+}
+
+// lastSeenString formats a device's last-seen timestamp, or "" if unknown.
+func lastSeenString(dev Device) string {
+	if dev.LastSeen == nil {
+		return ""
+	}
+	return dev.LastSeen.UTC().Format(time.RFC3339)
+}
+
+// sendMagicPacket sends the standard WoL magic packet (6x 0xFF followed by
+// 16 repetitions of the target MAC) over UDP/9 to broadcastAddr.
+func sendMagicPacket(mac, broadcastAddr string) error {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC %q: %v", mac, err)
+	}
+
+	packet := make([]byte, 0, 6+16*len(hwAddr))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xFF)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, hwAddr...)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(broadcastAddr, "9"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(packet)
+	return err
+}